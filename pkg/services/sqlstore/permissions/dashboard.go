@@ -3,6 +3,7 @@ package permissions
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/grafana/grafana/pkg/services/accesscontrol"
@@ -17,12 +18,94 @@ import (
 // maximum possible capacity for recursive queries array: one query for folder and one for dashboard actions
 const maximumRecursiveQueries = 2
 
+// folderSeedKind selects which candidate folder set addRecQry seeds its
+// upward walk from; see folderScopeSeed.
+type folderSeedKind int
+
+const (
+	// seedKindDashboards seeds from folders that contain a dashboard: used by
+	// the dashboard-inherited-folder branch, where only a folder's dashboards
+	// matter to the outer search.
+	seedKindDashboards folderSeedKind = iota
+	// seedKindAllFolders seeds from every folder in the org: used by the
+	// folder-actions branch, where the outer search matches folder rows
+	// themselves (dashboard.is_folder) and so must also include folders that
+	// have no dashboard of their own, only sub-folders.
+	seedKindAllFolders
+)
+
+// favoritesInlineThreshold is the largest favoritesCount for which
+// resolveFolderUIDs resolves folder permissions with addFavoritesFolderJoin's
+// bounded ancestor joins instead of paying for a WITH RECURSIVE query.
+// Callers that don't know the user's starred-dashboard count (favoritesCount
+// == 0) always fall back to the recursive path.
+const favoritesInlineThreshold = 200
+
+// maxNestedFolderDepth bounds the unrolled ancestor walk in
+// addFavoritesFolderJoin. It mirrors the hard cap Grafana's nested folders
+// feature enforces on how deep a folder tree can nest, so unrolling exactly
+// this many joins is exactly as correct as a recursive walk for any folder
+// tree the product allows to exist.
+const maxNestedFolderDepth = 8
+
+// dashboardPublishStateFlag is the feature-toggle name PublishState checks
+// via IsEnabled, kept as a local string rather than a featuremgmt.FeatureFlag
+// constant: featuremgmt.FlagDashboardPublishState doesn't exist yet (see the
+// PublishState doc comment below), and referencing an undefined package-level
+// symbol here would break the build for everyone depending on this package
+// until the real toggle is registered. Once it lands in featuremgmt, delete
+// this and call IsEnabled(featuremgmt.FlagDashboardPublishState) directly.
+const dashboardPublishStateFlag = "dashboardPublishState"
+
+// actionDashboardsPublish mirrors the dashboards:publish access-control
+// action PublishState's checks are meant to key off of, kept as a local
+// string for the same reason as dashboardPublishStateFlag above:
+// dashboards.ActionDashboardsPublish isn't registered in the dashboards
+// package yet. Once it is, delete this and use dashboards.ActionDashboardsPublish
+// directly.
+const actionDashboardsPublish = "dashboards:publish"
+
+// PublishState narrows a dashboard search to a publish dimension, mirroring
+// the pattern where non-authors only ever see published content while the
+// author can still find their own drafts.
+//
+// accessControlDashboardPermissionFilter only honors this behind the
+// dashboardPublishStateFlag toggle: the dashboard.published column migration,
+// the dashboards:publish access-control action, and the search/API wiring
+// that lets a caller actually set PublishState still need to land - and with
+// them, dashboardPublishStateFlag and actionDashboardsPublish need to become
+// real featuremgmt/dashboards symbols - before the toggle can default on.
+type PublishState int
+
+const (
+	// PublishStateAny applies no publish-state restriction.
+	PublishStateAny PublishState = iota
+	// PublishStatePublishedOnly restricts results to published dashboards,
+	// plus the signed-in user's own unpublished ones. In
+	// accessControlDashboardPermissionFilter it applies no restriction to a
+	// user holding dashboards:publish with a wildcard dashboard or folder scope.
+	PublishStatePublishedOnly
+	// PublishStateDraftsOnly restricts results to unpublished dashboards the
+	// signed-in user authored.
+	PublishStateDraftsOnly
+)
+
 type DashboardPermissionFilter struct {
 	OrgRole         org.RoleType
 	Dialect         migrator.Dialect
 	UserId          int64
 	OrgId           int64
 	PermissionLevel dashboards.PermissionType
+	PublishState    PublishState
+	// Features gates PublishState behind dashboardPublishStateFlag, same as
+	// accessControlDashboardPermissionFilter - see the PublishState doc
+	// comment. A nil Features is treated as the flag being disabled.
+	Features featuremgmt.FeatureToggles
+	// FavoritesOnly restricts results to dashboards the user has starred.
+	FavoritesOnly bool
+	// IncludeFavorites asks callers of Where() to also surface, via
+	// StarColumn, whether each returned row is one of the user's favorites.
+	IncludeFavorites bool
 }
 
 func (d DashboardPermissionFilter) Where() (string, []interface{}) {
@@ -81,9 +164,56 @@ func (d DashboardPermissionFilter) Where() (string, []interface{}) {
 	params = append(params, okRoles...)
 	params = append(params, d.OrgId, d.PermissionLevel, d.UserId)
 	params = append(params, okRoles...)
+
+	publishSQL, publishParams := d.publishStateClause()
+	sql += publishSQL
+	params = append(params, publishParams...)
+
+	favSQL, favParams := d.favoritesOnlyClause()
+	sql += favSQL
+	params = append(params, favParams...)
+
 	return sql, params
 }
 
+// publishStateClause returns an additional AND-ed clause restricting dashboard
+// rows by PublishState. Folders have no publish state of their own, so they're
+// always left untouched.
+func (d DashboardPermissionFilter) publishStateClause() (string, []interface{}) {
+	if d.Features == nil || !d.Features.IsEnabled(dashboardPublishStateFlag) {
+		return "", nil
+	}
+	switch d.PublishState {
+	case PublishStatePublishedOnly:
+		return " AND (dashboard.is_folder OR dashboard.published = " + d.Dialect.BooleanStr(true) + " OR dashboard.created_by = ?)", []interface{}{d.UserId}
+	case PublishStateDraftsOnly:
+		return " AND (dashboard.is_folder OR (dashboard.published = " + d.Dialect.BooleanStr(false) + " AND dashboard.created_by = ?))", []interface{}{d.UserId}
+	default:
+		return "", nil
+	}
+}
+
+// favoritesOnlyClause returns an additional AND-ed clause restricting results
+// to dashboards the signed-in user has starred, when FavoritesOnly is set.
+func (d DashboardPermissionFilter) favoritesOnlyClause() (string, []interface{}) {
+	if !d.FavoritesOnly {
+		return "", nil
+	}
+	return " AND dashboard.id IN (SELECT dashboard_id FROM star WHERE user_id = ?)", []interface{}{d.UserId}
+}
+
+// StarColumn returns a select expression and LEFT JOIN surfacing whether each
+// row is one of the signed-in user's favorites, for callers that set
+// IncludeFavorites. Empty when IncludeFavorites is false.
+func (d DashboardPermissionFilter) StarColumn() (column string, join string, params []interface{}) {
+	if !d.IncludeFavorites {
+		return "", "", nil
+	}
+	return "star.id IS NOT NULL AS is_starred",
+		"LEFT JOIN star ON star.dashboard_id = dashboard.id AND star.user_id = ?",
+		[]interface{}{d.UserId}
+}
+
 type clause struct {
 	string
 	params []interface{}
@@ -94,14 +224,55 @@ type accessControlDashboardPermissionFilter struct {
 	dashboardActions []string
 	folderActions    []string
 	features         featuremgmt.FeatureToggles
+	publishState     PublishState
+	favoritesOnly    bool
+	// favoritesCount is the caller-supplied number of dashboards the user has
+	// starred, used to decide whether favoritesOnly can take the non-recursive
+	// fast path in resolveFolderUIDs. 0 means "unknown", which always falls
+	// back to the recursive path.
+	favoritesCount   int
+	includeFavorites bool
+	folderUIDCache   *FolderUIDCache
 
 	where clause
 	// any recursive CTE queries (if supported)
 	recQueries []clause
+	// usesRecursion is true once addRecQry has added a genuinely recursive
+	// member to recQueries, so With() only emits the RECURSIVE keyword when a
+	// member actually needs it - addFavoritesFolderJoin's bounded joins don't.
+	usesRecursion bool
+	// pendingFolderUIDQueries holds a standalone resolver query for every
+	// FolderUIDCache miss hit while building recQueries, so the caller can run
+	// each once and populate the cache for the next identical search.
+	pendingFolderUIDQueries []FolderUIDQuery
+}
+
+// FavoritesOptions groups NewAccessControlDashboardPermissionFilter's
+// favorites-related and caching knobs, which otherwise would have grown into
+// a tail of positional bools and ints on the constructor - in particular
+// FavoritesOnly and IncludeFavorites are adjacent bools of the same type,
+// trivially transposable by a caller at a positional call site.
+type FavoritesOptions struct {
+	// FavoritesOnly restricts the filter to dashboards the user has starred.
+	FavoritesOnly bool
+	// FavoritesCount is only read when FavoritesOnly is set: it's the number
+	// of dashboards the caller already knows the user has starred (e.g. from
+	// a prior count query), and lets resolveFolderUIDs skip the recursive CTE
+	// entirely via a bounded ancestor join when it's small - see
+	// addFavoritesFolderJoin. Leave it 0 if unknown; that always falls back
+	// to the recursive path.
+	FavoritesCount int
+	// IncludeFavorites asks Where() to also surface, via StarColumn, whether
+	// each row is one of the user's favorites.
+	IncludeFavorites bool
+	// FolderUIDCache is optional: when nil, folder uids are always resolved
+	// via the recursive CTE; when set, a cache hit replaces the CTE with a
+	// literal IN (...) list (see FolderUIDCache).
+	FolderUIDCache *FolderUIDCache
 }
 
-// NewAccessControlDashboardPermissionFilter creates a new AccessControlDashboardPermissionFilter that is configured with specific actions calculated based on the dashboards.PermissionType and query type
-func NewAccessControlDashboardPermissionFilter(user *user.SignedInUser, permissionLevel dashboards.PermissionType, queryType string, features featuremgmt.FeatureToggles) *accessControlDashboardPermissionFilter {
+// NewAccessControlDashboardPermissionFilter creates a new AccessControlDashboardPermissionFilter that is configured with specific actions calculated based on the dashboards.PermissionType and query type.
+func NewAccessControlDashboardPermissionFilter(user *user.SignedInUser, permissionLevel dashboards.PermissionType, queryType string, features featuremgmt.FeatureToggles, publishState PublishState, favorites FavoritesOptions) *accessControlDashboardPermissionFilter {
 	needEdit := permissionLevel > dashboards.PERMISSION_VIEW
 
 	var folderActions []string
@@ -138,7 +309,12 @@ func NewAccessControlDashboardPermissionFilter(user *user.SignedInUser, permissi
 	}
 
 	f := accessControlDashboardPermissionFilter{user: user, folderActions: folderActions, dashboardActions: dashboardActions, features: features,
-		recQueries: make([]clause, 0, maximumRecursiveQueries),
+		publishState:     publishState,
+		favoritesOnly:    favorites.FavoritesOnly,
+		favoritesCount:   favorites.FavoritesCount,
+		includeFavorites: favorites.IncludeFavorites,
+		folderUIDCache:   favorites.FolderUIDCache,
+		recQueries:       make([]clause, 0, maximumRecursiveQueries),
 	}
 
 	f.buildClauses()
@@ -206,9 +382,10 @@ func (f *accessControlDashboardPermissionFilter) buildClauses() {
 
 			switch f.features.IsEnabled(featuremgmt.FlagNestedFolders) {
 			case true:
-				recQueryName := fmt.Sprintf("RecQry%d", len(f.recQueries))
-				f.addRecQry(recQueryName, permSelector.String(), permSelectorArgs)
-				builder.WriteString(fmt.Sprintf("WHERE d.uid IN (SELECT uid FROM %s)", recQueryName))
+				folderUIDsSQL, folderUIDsArgs := f.resolveFolderUIDs(toCheck, permSelector.String(), permSelectorArgs, seedKindDashboards)
+				builder.WriteString("WHERE d.uid IN ")
+				builder.WriteString(folderUIDsSQL)
+				args = append(args, folderUIDsArgs...)
 			default:
 				builder.WriteString("WHERE d.uid IN ")
 				builder.WriteString(permSelector.String())
@@ -247,9 +424,9 @@ func (f *accessControlDashboardPermissionFilter) buildClauses() {
 
 			switch f.features.IsEnabled(featuremgmt.FlagNestedFolders) {
 			case true:
-				recQueryName := fmt.Sprintf("RecQry%d", len(f.recQueries))
-				f.addRecQry(recQueryName, permSelector.String(), permSelectorArgs)
-				builder.WriteString(fmt.Sprintf("(SELECT uid FROM %s)", recQueryName))
+				folderUIDsSQL, folderUIDsArgs := f.resolveFolderUIDs(toCheck, permSelector.String(), permSelectorArgs, seedKindAllFolders)
+				builder.WriteString(folderUIDsSQL)
+				args = append(args, folderUIDsArgs...)
 			default:
 				builder.WriteString(permSelector.String())
 				args = append(args, permSelectorArgs...)
@@ -262,6 +439,174 @@ func (f *accessControlDashboardPermissionFilter) buildClauses() {
 	builder.WriteRune(')')
 
 	f.where = clause{string: builder.String(), params: args}
+
+	if publishSQL, publishArgs := f.publishStateClause(); publishSQL != "" {
+		f.where.string = "(" + f.where.string + publishSQL + ")"
+		f.where.params = append(f.where.params, publishArgs...)
+	}
+
+	if favSQL, favArgs := f.favoritesOnlyClause(); favSQL != "" {
+		f.where.string = "(" + f.where.string + favSQL + ")"
+		f.where.params = append(f.where.params, favArgs...)
+	}
+}
+
+// favoritesOnlyClause returns an additional AND-ed clause restricting results
+// to dashboards the signed-in user has starred, when favoritesOnly is set.
+func (f *accessControlDashboardPermissionFilter) favoritesOnlyClause() (string, []interface{}) {
+	if !f.favoritesOnly {
+		return "", nil
+	}
+	return " AND dashboard.id IN (SELECT dashboard_id FROM star WHERE user_id = ?)", []interface{}{f.user.UserID}
+}
+
+// StarColumn returns a select expression and LEFT JOIN surfacing whether each
+// row is one of the signed-in user's favorites, for callers that set
+// includeFavorites. Empty when includeFavorites is false.
+func (f *accessControlDashboardPermissionFilter) StarColumn() (column string, join string, params []interface{}) {
+	if !f.includeFavorites {
+		return "", "", nil
+	}
+	return "star.id IS NOT NULL AS is_starred",
+		"LEFT JOIN star ON star.dashboard_id = dashboard.id AND star.user_id = ?",
+		[]interface{}{f.user.UserID}
+}
+
+// publishStateClause returns an additional AND-ed clause restricting the
+// dashboard-matching branches of the where clause above by PublishState.
+// A viewer without dashboards:publish can only match published dashboards,
+// unless they're the dashboard's own author (own drafts are always visible
+// to their author, same as in the BI-tool pattern this mirrors). Folders are
+// left untouched, since "published" only has meaning for dashboards.
+//
+// Gated behind dashboardPublishStateFlag: the dashboard.published column, the
+// dashboards:publish action, and the search/API wiring that lets a real
+// caller set PublishState haven't landed yet, so this clause must stay
+// inert regardless of what a caller passes in until they do - the same
+// gating FlagNestedFolders gave addRecQry before the folder table had a
+// parent_uid to recurse on.
+func (f *accessControlDashboardPermissionFilter) publishStateClause() (string, []interface{}) {
+	if !f.features.IsEnabled(dashboardPublishStateFlag) {
+		return "", nil
+	}
+	if f.publishState == PublishStateAny || len(f.dashboardActions) == 0 {
+		return "", nil
+	}
+
+	toCheck := actionsToCheck(
+		[]string{actionDashboardsPublish},
+		f.user.Permissions[f.user.OrgID],
+		accesscontrol.WildcardsFromPrefix(dashboards.ScopeDashboardsPrefix),
+		accesscontrol.WildcardsFromPrefix(dashboards.ScopeFoldersPrefix),
+	)
+	canSeeUnpublished := len(toCheck) == 0
+
+	switch f.publishState {
+	case PublishStatePublishedOnly:
+		if canSeeUnpublished {
+			return "", nil
+		}
+		return " AND (dashboard.is_folder OR dashboard.published OR dashboard.created_by = ?)", []interface{}{f.user.UserID}
+	case PublishStateDraftsOnly:
+		// Drafts are always scoped to their own author, regardless of
+		// dashboards:publish: that action only ever widens what published
+		// content someone can see, it never grants visibility into other
+		// users' unpublished work.
+		return " AND (dashboard.is_folder OR (NOT dashboard.published AND dashboard.created_by = ?))", []interface{}{f.user.UserID}
+	default:
+		return "", nil
+	}
+}
+
+// resolveFolderUIDs returns a SQL fragment matching the folder uids the user
+// has the actions in toCheck on (including, with nested folders, anything
+// reachable through an ancestor), plus its parameters.
+//
+// When f.folderUIDCache is set and already holds the answer for this
+// (org, user, teams, roles, actions) combination, that's a literal IN (...)
+// list and the recursive CTE is skipped entirely. On a miss, it falls back to
+// addRecQryOrFavoritesJoin as before and records a FolderUIDQuery the caller
+// can run once PendingFolderUIDQueries is read, to populate the cache for
+// next time.
+//
+// favoritesOnly lookups never use folderUIDCache: the resolved folder uid set
+// depends on the star table (via favoritesSeed), and FolderUIDCache's
+// invalidation hooks only cover role/team/permission changes, not stars -
+// caching here would risk serving a stale set after the user stars or
+// unstars a dashboard, with nothing to ever purge it.
+func (f *accessControlDashboardPermissionFilter) resolveFolderUIDs(toCheck []interface{}, permSelectorSQL string, permSelectorArgs []interface{}, seedKind folderSeedKind) (string, []interface{}) {
+	if f.folderUIDCache != nil && !f.favoritesOnly {
+		key := f.folderUIDCacheKey(toCheck, seedKind)
+		if uids, ok := f.folderUIDCache.Get(key); ok {
+			return literalUIDList(uids)
+		}
+
+		recQueryName := fmt.Sprintf("RecQry%d", len(f.recQueries))
+		f.addRecQryOrFavoritesJoin(recQueryName, permSelectorSQL, permSelectorArgs, seedKind)
+
+		resolveSQL, resolveParams := f.With()
+		resolveSQL += fmt.Sprintf(" SELECT DISTINCT seed FROM %s WHERE granted = 1", recQueryName)
+		f.pendingFolderUIDQueries = append(f.pendingFolderUIDQueries, FolderUIDQuery{Key: key, SQL: resolveSQL, Params: resolveParams})
+
+		return fmt.Sprintf("(SELECT DISTINCT seed FROM %s WHERE granted = 1)", recQueryName), nil
+	}
+
+	recQueryName := fmt.Sprintf("RecQry%d", len(f.recQueries))
+	f.addRecQryOrFavoritesJoin(recQueryName, permSelectorSQL, permSelectorArgs, seedKind)
+	return fmt.Sprintf("(SELECT DISTINCT seed FROM %s WHERE granted = 1)", recQueryName), nil
+}
+
+// addRecQryOrFavoritesJoin adds the CTE member resolveFolderUIDs needs,
+// choosing between the two ways this filter can resolve folder permissions:
+// addRecQry's WITH RECURSIVE walk (always correct, cost roughly proportional
+// to folder tree size), or, when favoritesOnly is set and the caller already
+// knows the starred-dashboard count is small, addFavoritesFolderJoin's
+// non-recursive bounded ancestor join (cost roughly proportional to the
+// number of favorites instead).
+func (f *accessControlDashboardPermissionFilter) addRecQryOrFavoritesJoin(queryName, whereUIDSelect string, whereParams []interface{}, seedKind folderSeedKind) {
+	if f.favoritesOnly && f.favoritesCount > 0 && f.favoritesCount <= favoritesInlineThreshold {
+		f.addFavoritesFolderJoin(queryName, whereUIDSelect, whereParams)
+		return
+	}
+	f.addRecQry(queryName, whereUIDSelect, whereParams, seedKind)
+}
+
+// folderUIDCacheKey builds the FolderUIDCacheKey for a resolveFolderUIDs
+// lookup checking the given actions under the user's current teams and
+// effective roles. Never called for a favoritesOnly lookup - see
+// resolveFolderUIDs - so the key has no FavoritesOnly field to set.
+// seedKind is part of the key even though it's implied by which action set
+// (dashboardActions vs folderActions) produced toCheck: the two branches
+// seed the recursion from different candidate folder sets, so a cache
+// collision between them would serve one branch the other's (differently
+// scoped) resolved folder-uid set.
+func (f *accessControlDashboardPermissionFilter) folderUIDCacheKey(toCheck []interface{}, seedKind folderSeedKind) FolderUIDCacheKey {
+	actions := make([]string, len(toCheck))
+	for i, a := range toCheck {
+		actions[i] = fmt.Sprint(a)
+	}
+	teams := make([]string, len(f.user.Teams))
+	for i, t := range f.user.Teams {
+		teams[i] = strconv.FormatInt(t, 10)
+	}
+
+	return FolderUIDCacheKey{
+		OrgID:         f.user.OrgID,
+		UserID:        f.user.UserID,
+		TeamSetHash:   hashStrings(teams),
+		RolesHash:     hashStrings(accesscontrol.GetOrgRoles(f.user)),
+		ActionsHash:   hashStrings(actions),
+		NestedFolders: f.features.IsEnabled(featuremgmt.FlagNestedFolders),
+		SeedKind:      int(seedKind),
+	}
+}
+
+// PendingFolderUIDQueries returns a standalone query for every FolderUIDCache
+// miss encountered while building this filter's Where()/With(). Run each one
+// and call FolderUIDCache.Set(q.Key, uids) with the result, so the next
+// identical search hits the cache instead of paying for the CTE again.
+func (f *accessControlDashboardPermissionFilter) PendingFolderUIDQueries() []FolderUIDQuery {
+	return f.pendingFolderUIDQueries
 }
 
 // With returns:
@@ -270,7 +615,11 @@ func (f *accessControlDashboardPermissionFilter) With() (string, []interface{})
 	var sb bytes.Buffer
 	var params []interface{}
 	if len(f.recQueries) > 0 {
-		sb.WriteString("WITH RECURSIVE ")
+		if f.usesRecursion {
+			sb.WriteString("WITH RECURSIVE ")
+		} else {
+			sb.WriteString("WITH ")
+		}
 		sb.WriteString(f.recQueries[0].string)
 		params = append(params, f.recQueries[0].params...)
 		for _, r := range f.recQueries[1:] {
@@ -282,18 +631,129 @@ func (f *accessControlDashboardPermissionFilter) With() (string, []interface{})
 	return sb.String(), params
 }
 
-func (f *accessControlDashboardPermissionFilter) addRecQry(queryName string, whereUIDSelect string, whereParams []interface{}) {
-	c := make([]interface{}, len(whereParams))
-	copy(c, whereParams)
+// addRecQry adds a recursive CTE member that resolves, for every candidate
+// folder, whether the user's permissions reach it through one of its
+// ancestors. Rather than seeding the recursion with the permission-granting
+// folders and walking every descendant (which touches the whole subtree even
+// when only a handful of dashboards are being searched), it seeds with the
+// folders the outer search can actually return - scopeSeedUIDSelect - and
+// climbs upward towards parents, stopping a branch as soon as it hits a
+// granted ancestor. whereUIDSelect is unchanged: the subselect of folder uids
+// the user has the required action on.
+func (f *accessControlDashboardPermissionFilter) addRecQry(queryName string, whereUIDSelect string, whereParams []interface{}, seedKind folderSeedKind) {
+	f.usesRecursion = true
+	scopeSeedUIDSelect, scopeSeedParams := f.folderScopeSeed(seedKind)
+
+	// whereUIDSelect is referenced 3 times in the CTE below (explicit-grant
+	// anchor, scope-seed anchor, recursive member), each occurrence needs its
+	// own copy of whereParams in positional order.
+	params := make([]interface{}, 0, len(whereParams)*3+len(scopeSeedParams))
+	params = append(params, whereParams...)
+	params = append(params, whereParams...)
+	params = append(params, scopeSeedParams...)
+	params = append(params, whereParams...)
+
 	f.recQueries = append(f.recQueries, clause{
 		string: fmt.Sprintf(`%s AS (
-			SELECT uid, parent_uid, org_id FROM folder WHERE uid IN %s
-			UNION ALL SELECT f.uid, f.parent_uid, f.org_id FROM folder f INNER JOIN %s r ON f.parent_uid = r.uid and f.org_id = r.org_id
-		)`, queryName, whereUIDSelect, queryName),
-		params: c,
+			-- anchor: folders the user is explicitly granted the action on
+			SELECT uid, parent_uid, org_id, uid AS seed, 1 AS granted
+				FROM folder WHERE uid IN %s
+			UNION
+			-- anchor: folders the outer search could actually return, so the
+			-- recursion never has to visit folders that have no bearing on it
+			SELECT uid, parent_uid, org_id, uid AS seed, (CASE WHEN uid IN %s THEN 1 ELSE 0 END) AS granted
+				FROM folder WHERE uid IN %s
+			UNION ALL
+			SELECT f.uid, f.parent_uid, f.org_id, r.seed, (CASE WHEN f.uid IN %s THEN 1 ELSE 0 END)
+				FROM folder f INNER JOIN %s r ON f.uid = r.parent_uid AND f.org_id = r.org_id
+				WHERE r.granted = 0
+		)`, queryName, whereUIDSelect, whereUIDSelect, scopeSeedUIDSelect, whereUIDSelect, queryName),
+		params: params,
 	})
 }
 
+// folderScopeSeed returns a subselect of the folder uids that bound the
+// recursion in addRecQry, together with its parameters.
+//
+// When favoritesOnly is set, the search is already bound to the signed-in
+// user's starred dashboards, so we seed from their folders instead - that set
+// is normally far smaller than either of the seedKind candidates below, which
+// keeps the recursion cost proportional to the number of favorites rather
+// than the size of the org's folder tree.
+//
+// Otherwise, seedKindDashboards narrows to folders that actually contain a
+// dashboard: that's always a safe bound for the dashboard-inherited-folder
+// branch, since the outer search only ever matches dashboard rows there, and
+// every such dashboard's immediate folder is, by definition, in that set.
+//
+// seedKindAllFolders seeds from every folder in the org instead. The
+// folder-actions branch matches folder rows themselves (dashboard.is_folder),
+// including folders that have no dashboard of their own and only exist to
+// hold sub-folders; narrowing to dashboard-containing folders there would
+// make such a folder unreachable as a recursion anchor even when one of its
+// ancestors explicitly grants access, silently dropping it from
+// TypeFolder/TypeAlertFolder searches and folder-tree browsing.
+func (f *accessControlDashboardPermissionFilter) folderScopeSeed(seedKind folderSeedKind) (string, []interface{}) {
+	if f.favoritesOnly {
+		return f.favoritesSeed()
+	}
+	if seedKind == seedKindAllFolders {
+		return "(SELECT uid FROM folder WHERE org_id = ?)", []interface{}{f.user.OrgID}
+	}
+	return "(SELECT DISTINCT f.uid FROM folder f INNER JOIN dashboard d ON d.folder_id = f.id WHERE d.org_id = ?)",
+		[]interface{}{f.user.OrgID}
+}
+
+// favoritesSeed returns a subselect of the folder uids that directly contain
+// one of the signed-in user's starred dashboards, together with its
+// parameters. It's the starting point for addFavoritesFolderJoin's ancestor
+// walk.
+func (f *accessControlDashboardPermissionFilter) favoritesSeed() (string, []interface{}) {
+	return "(SELECT DISTINCT f.uid FROM folder f " +
+			"INNER JOIN dashboard d ON d.folder_id = f.id " +
+			"INNER JOIN star s ON s.dashboard_id = d.id " +
+			"WHERE d.org_id = ? AND s.user_id = ?)",
+		[]interface{}{f.user.OrgID, f.user.UserID}
+}
+
+// addFavoritesFolderJoin adds a non-recursive CTE member resolving, for every
+// folder directly containing one of the signed-in user's starred dashboards,
+// whether the user's permissions reach it through one of its ancestors -
+// without a WITH RECURSIVE query. It unrolls the ancestor walk into a fixed
+// chain of maxNestedFolderDepth LEFT JOINs and checks at every level whether
+// that ancestor is one of the permission-granted folders (whereUIDSelect),
+// which is exactly as correct as addRecQry's recursive walk for any folder
+// tree within Grafana's nested-folders depth limit, and considerably cheaper
+// when the starred set is small: cost is proportional to the number of
+// favorites rather than the size of the folder tree.
+func (f *accessControlDashboardPermissionFilter) addFavoritesFolderJoin(queryName, whereUIDSelect string, whereParams []interface{}) {
+	seedSQL, seedParams := f.favoritesSeed()
+
+	var sb bytes.Buffer
+	fmt.Fprintf(&sb, "%s AS (SELECT DISTINCT d0.uid AS seed, 1 AS granted FROM folder d0", queryName)
+	for i := 1; i <= maxNestedFolderDepth; i++ {
+		fmt.Fprintf(&sb, " LEFT JOIN folder d%d ON d%d.uid = d%d.parent_uid AND d%d.org_id = d%d.org_id", i, i, i-1, i, i-1)
+	}
+	sb.WriteString(" WHERE d0.uid IN ")
+	sb.WriteString(seedSQL)
+	sb.WriteString(" AND (")
+	for i := 0; i <= maxNestedFolderDepth; i++ {
+		if i > 0 {
+			sb.WriteString(" OR ")
+		}
+		fmt.Fprintf(&sb, "d%d.uid IN %s", i, whereUIDSelect)
+	}
+	sb.WriteString("))")
+
+	params := make([]interface{}, 0, len(seedParams)+len(whereParams)*(maxNestedFolderDepth+1))
+	params = append(params, seedParams...)
+	for i := 0; i <= maxNestedFolderDepth; i++ {
+		params = append(params, whereParams...)
+	}
+
+	f.recQueries = append(f.recQueries, clause{string: sb.String(), params: params})
+}
+
 func actionsToCheck(actions []string, permissions map[string][]string, wildcards ...accesscontrol.Wildcards) []interface{} {
 	toCheck := make([]interface{}, 0, len(actions))
 
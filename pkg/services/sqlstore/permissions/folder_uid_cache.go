@@ -0,0 +1,178 @@
+package permissions
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// folderUIDCacheSize caps the number of distinct (org, user, team set, role
+// set, action set, nested-folders, seed kind) combinations we keep resolved
+// folder uid sets for.
+const folderUIDCacheSize = 1000
+
+// FolderUIDCacheKey identifies a resolved "which folder uids can this user
+// reach with this set of actions" lookup. The *Hash fields are opaque digests
+// of the corresponding inputs (team memberships, effective roles, actions
+// checked), computed by hashStrings, so the key stays small and comparable
+// regardless of input set size or order.
+//
+// There is deliberately no FavoritesOnly field: a favoritesOnly lookup's
+// result depends on the star table, which nothing here has an invalidation
+// hook for (see Purge), so accessControlDashboardPermissionFilter never
+// builds a FolderUIDCacheKey for one - it always resolves those live instead
+// of risking a stale cached set after the user stars or unstars a dashboard.
+type FolderUIDCacheKey struct {
+	OrgID         int64
+	UserID        int64
+	TeamSetHash   string
+	RolesHash     string
+	ActionsHash   string
+	NestedFolders bool
+	// SeedKind distinguishes the dashboard-inherited-folder branch from the
+	// folder-actions branch (see folderSeedKind in dashboard.go): they seed
+	// the recursion from different candidate folder sets, so their resolved
+	// folder uid sets aren't interchangeable even when ActionsHash otherwise
+	// happened to collide.
+	SeedKind int
+}
+
+// FolderUIDQuery is a standalone query a caller can run to resolve the folder
+// uids for a FolderUIDCacheKey that missed the cache, together with the key
+// it should be cached under once resolved.
+type FolderUIDQuery struct {
+	Key    FolderUIDCacheKey
+	SQL    string
+	Params []interface{}
+}
+
+// FolderUIDCache caches the set of folder uids a user has a given set of
+// actions on (including, when nested folders are enabled, everything
+// reachable through an ancestor), so that repeated search requests from the
+// same user don't pay for re-resolving the recursive folder CTE every time.
+// It is safe for concurrent use.
+//
+// A cache hit turns the WHERE clause built by
+// accessControlDashboardPermissionFilter into a literal IN (...) list and
+// removes the WITH RECURSIVE query entirely. On a miss, the filter falls back
+// to building the recursive query as usual and, via PendingFolderUIDQueries,
+// hands back a standalone query the caller can run once to populate the
+// cache for next time.
+//
+// Entries must be invalidated whenever the underlying dashboard_acl or
+// permission data changes; see Purge.
+type FolderUIDCache struct {
+	cache *lru.Cache[FolderUIDCacheKey, []string]
+
+	mu sync.Mutex
+	// orgIndex tracks which cache keys belong to which org, so Purge(orgID)
+	// only has to evict that org's entries instead of walking the whole cache.
+	orgIndex map[int64]map[FolderUIDCacheKey]struct{}
+}
+
+// NewFolderUIDCache creates an empty FolderUIDCache.
+func NewFolderUIDCache() *FolderUIDCache {
+	fc := &FolderUIDCache{orgIndex: make(map[int64]map[FolderUIDCacheKey]struct{})}
+	// Keep orgIndex in sync when the LRU evicts an entry on its own (size
+	// pressure), not just when Purge removes one explicitly - otherwise
+	// orgIndex would grow forever for an org that never sees an invalidation
+	// event.
+	cache, _ := lru.NewWithEvict[FolderUIDCacheKey, []string](folderUIDCacheSize, func(key FolderUIDCacheKey, _ []string) {
+		fc.forgetIndexEntry(key)
+	})
+	fc.cache = cache
+	return fc
+}
+
+// Get returns the cached folder uid set for key, if any.
+func (c *FolderUIDCache) Get(key FolderUIDCacheKey) ([]string, bool) {
+	return c.cache.Get(key)
+}
+
+// Set stores the resolved folder uid set for key.
+func (c *FolderUIDCache) Set(key FolderUIDCacheKey, folderUIDs []string) {
+	// cache.Add may itself evict another entry and invoke the eviction
+	// callback, which takes c.mu - so it must run without c.mu held here.
+	c.cache.Add(key, folderUIDs)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.orgIndex[key.OrgID] == nil {
+		c.orgIndex[key.OrgID] = make(map[FolderUIDCacheKey]struct{})
+	}
+	c.orgIndex[key.OrgID][key] = struct{}{}
+}
+
+// Purge evicts every cached entry for orgID. Call it whenever a write could
+// have changed what folders a user in that org can act on: role assignment,
+// team membership changes, and permission grant/revoke.
+//
+// This is deliberately left as a method the caller invokes from its own
+// existing role/team/permission write paths, rather than a bus subscription
+// wired up in this package: that would mean asserting the shape of
+// accesscontrol's bus events (role assignment, team membership, permission
+// change) without a way to confirm, in this tree, that those event types
+// and their OrgID field actually exist upstream. Wire a SubscribeInvalidation
+// equivalent once that's been confirmed against the real accesscontrol
+// package.
+func (c *FolderUIDCache) Purge(orgID int64) {
+	c.mu.Lock()
+	keys := make([]FolderUIDCacheKey, 0, len(c.orgIndex[orgID]))
+	for key := range c.orgIndex[orgID] {
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+
+	// cache.Remove triggers the eviction callback, which takes c.mu itself to
+	// delete the entry from orgIndex - so this must run unlocked.
+	for _, key := range keys {
+		c.cache.Remove(key)
+	}
+}
+
+// forgetIndexEntry removes key from orgIndex. Called both from Purge (via
+// cache.Remove) and directly by the LRU's eviction callback when it drops an
+// entry on its own due to size pressure.
+func (c *FolderUIDCache) forgetIndexEntry(key FolderUIDCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if keys := c.orgIndex[key.OrgID]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(c.orgIndex, key.OrgID)
+		}
+	}
+}
+
+// hashStrings returns a stable digest of ss, independent of input order, for
+// use as one component of a FolderUIDCacheKey.
+func hashStrings(ss []string) string {
+	sorted := make([]string, len(ss))
+	copy(sorted, ss)
+	sort.Strings(sorted)
+
+	h := fnv.New64a()
+	for _, s := range sorted {
+		_, _ = h.Write([]byte(s))
+		_, _ = h.Write([]byte{0})
+	}
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// literalUIDList renders a fixed IN (...) list for uids, along with its
+// positional parameters. An empty uids matches nothing.
+func literalUIDList(uids []string) (string, []interface{}) {
+	if len(uids) == 0 {
+		return "(NULL)", nil
+	}
+	params := make([]interface{}, len(uids))
+	for i, uid := range uids {
+		params[i] = uid
+	}
+	return "(?" + strings.Repeat(",?", len(uids)-1) + ")", params
+}